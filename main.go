@@ -27,13 +27,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -59,7 +68,6 @@ type Response struct {
 const initialUnixTimestamp int64 = 1622366082
 
 var now time.Time = time.Unix(initialUnixTimestamp, 0)
-var data Timestamp = Timestamp{timestamp: &now}
 
 func (t Timestamp) MarshalJSON() ([]byte, error) {
 	log.Debugf("my MarshalJSON called")
@@ -86,29 +94,619 @@ func (t *Timestamp) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// Use this channel for mutual exclusion.
-// Only one thread can be in the critical section.
-var l = make(chan int, 1) // RQ4
+// Store abstracts over where the timestamp persists, so the HTTP layer (Server) does not depend
+// on any one backend.
+type Store interface {
+	Get(ctx context.Context) (Timestamp, error)
+	Set(ctx context.Context, value Timestamp) error
+}
+
+// Subscribable is implemented by Store backends that can push updates to subscribers, backing
+// GET /timestamp/subscribe.
+type Subscribable interface {
+	Subscribe(id clientID) (<-chan Timestamp, error)
+	Unsubscribe(id clientID)
+}
+
+// Swapper is implemented by Store backends that support PUT /timestamp/cas.
+type Swapper interface {
+	CompareAndSwap(ctx context.Context, expected, newValue Timestamp) (bool, error)
+}
+
+// Historian is implemented by Store backends that support GET /timestamp/history.
+type Historian interface {
+	History(ctx context.Context, n int) ([]historyEntry, error)
+}
+
+// storeOpKind tags which operation a storeOp asks memoryStore's actor goroutine to perform.
+type storeOpKind int
+
+const (
+	opGet storeOpKind = iota
+	opSet
+	opCAS
+	opHistory
+)
+
+// historyEntry is one past value recorded by memoryStore, in the order it was written.
+type historyEntry struct {
+	value     Timestamp
+	writtenAt time.Time
+}
+
+// storeOp is sent on memoryStore.ops; the actor goroutine replies on reply exactly once.
+type storeOp struct {
+	kind     storeOpKind
+	value    Timestamp // opSet: the new value. opCAS: the value to swap in if expected matches.
+	expected Timestamp // opCAS only
+	n        int       // opHistory: how many most-recent entries to return (<=0 means all)
+	reply    chan storeReply
+}
+
+// storeReply carries back whatever the requested storeOp produced.
+type storeReply struct {
+	value   Timestamp
+	swapped bool
+	history []historyEntry
+}
+
+// sendOp sends op on ops and waits for its reply, honouring ctx cancellation on both sides. op's
+// reply channel must be buffered so the actor goroutine never blocks forever delivering a reply
+// nobody is left to receive.
+func sendOp(ctx context.Context, ops chan<- storeOp, op storeOp) (storeReply, error) {
+	select {
+	case ops <- op:
+	case <-ctx.Done():
+		return storeReply{}, ctx.Err()
+	}
+
+	select {
+	case r := <-op.reply:
+		return r, nil
+	case <-ctx.Done():
+		return storeReply{}, ctx.Err()
+	}
+}
+
+// memoryStore is the original in-memory backend. A single owner goroutine (run) serializes every
+// operation - still no sync.Mutex, per RQ4 - and fans updates out to websocket subscribers
+// through its hub. It is the only backend in this revision that also implements
+// Swapper/Historian/Subscribable; other backends satisfy only the base Store interface.
+type memoryStore struct {
+	ops chan storeOp
+	hub *subscriberHub
+}
+
+func newMemoryStore(initial Timestamp) *memoryStore {
+	hub := newSubscriberHub()
+	ms := &memoryStore{ops: make(chan storeOp), hub: hub}
+
+	go hub.run()
+	<-hub.ready // ms.run sends to hub.broadcast on every Set/CAS; it must not start first.
+	go ms.run(initial)
+
+	return ms
+}
+
+// run owns current and history outright; nothing outside this goroutine touches them.
+func (ms *memoryStore) run(initial Timestamp) {
+	current := initial
+	history := []historyEntry{{value: current, writtenAt: time.Now()}}
+
+	for op := range ms.ops {
+		switch op.kind {
+		case opGet:
+			op.reply <- storeReply{value: current}
+
+		case opSet:
+			current = op.value
+			history = append(history, historyEntry{value: current, writtenAt: time.Now()})
+			ms.hub.broadcast <- current
+			op.reply <- storeReply{value: current}
 
-func getData() Timestamp { // RQ4
-	l <- 1
-	defer func() { <-l }()
+		case opCAS:
+			swapped := timestampEqual(current, op.expected)
+			if swapped {
+				current = op.value
+				history = append(history, historyEntry{value: current, writtenAt: time.Now()})
+				ms.hub.broadcast <- current
+			}
+			op.reply <- storeReply{value: current, swapped: swapped}
 
-	return data
+		case opHistory:
+			n := op.n
+			if n <= 0 || n > len(history) {
+				n = len(history)
+			}
+			op.reply <- storeReply{history: append([]historyEntry(nil), history[len(history)-n:]...)}
+		}
+	}
+}
+
+func (ms *memoryStore) Get(ctx context.Context) (Timestamp, error) {
+	r, err := sendOp(ctx, ms.ops, storeOp{kind: opGet, reply: make(chan storeReply, 1)})
+	return r.value, err
+}
+
+func (ms *memoryStore) Set(ctx context.Context, value Timestamp) error {
+	_, err := sendOp(ctx, ms.ops, storeOp{kind: opSet, value: value, reply: make(chan storeReply, 1)})
+	return err
 }
 
-func setData(newValue Timestamp) { // RQ4
-	l <- 1
-	defer func() { <-l }()
+// CompareAndSwap performs an atomic compare-and-swap: value is stored only if the current value
+// equals expected. It reports whether the swap happened.
+func (ms *memoryStore) CompareAndSwap(ctx context.Context, expected, value Timestamp) (bool, error) {
+	r, err := sendOp(ctx, ms.ops, storeOp{kind: opCAS, expected: expected, value: value, reply: make(chan storeReply, 1)})
+	return r.swapped, err
+}
+
+// History returns the n most recently written values, oldest first. n<=0 returns the full
+// history.
+func (ms *memoryStore) History(ctx context.Context, n int) ([]historyEntry, error) {
+	r, err := sendOp(ctx, ms.ops, storeOp{kind: opHistory, n: n, reply: make(chan storeReply, 1)})
+	return r.history, err
+}
+
+func (ms *memoryStore) Subscribe(id clientID) (<-chan Timestamp, error) {
+	ch := make(chan Timestamp, wsSendBufferSize)
+	ms.hub.register <- subscriber{id: id, ch: ch}
+	return ch, nil
+}
 
-	data = newValue
+func (ms *memoryStore) Unsubscribe(id clientID) {
+	ms.hub.unregister <- id
 }
 
-func returnTimestamp(w http.ResponseWriter, r *http.Request) {
-	_ = json.NewEncoder(w).Encode(getData())
+// timestampEqual reports whether a and b represent the same point in time.
+func timestampEqual(a, b Timestamp) bool {
+	if a.timestamp == nil || b.timestamp == nil {
+		return a.timestamp == b.timestamp
+	}
+	return a.timestamp.Unix() == b.timestamp.Unix()
+}
+
+// serialOpKind tags which operation a serialOp asks serialStore's actor goroutine to perform.
+type serialOpKind int
+
+const (
+	serialOpGet serialOpKind = iota
+	serialOpSet
+)
+
+type serialOp struct {
+	kind  serialOpKind
+	value Timestamp
+	reply chan serialReply
+}
+
+type serialReply struct {
+	value Timestamp
+	err   error
+}
+
+// serialStore provides the owner-goroutine serialization pattern shared by the file- and
+// bbolt-backed stores: a single goroutine owns the in-memory current value and calls persist
+// before acknowledging every Set, so a failed write never silently diverges from what callers
+// believe was stored.
+type serialStore struct {
+	ops     chan serialOp
+	persist func(Timestamp) error
+}
+
+func newSerialStore(initial Timestamp, persist func(Timestamp) error) *serialStore {
+	s := &serialStore{ops: make(chan serialOp), persist: persist}
+	go s.run(initial)
+	return s
+}
+
+func (s *serialStore) run(current Timestamp) {
+	for op := range s.ops {
+		switch op.kind {
+		case serialOpGet:
+			op.reply <- serialReply{value: current}
+
+		case serialOpSet:
+			if err := s.persist(op.value); err != nil {
+				op.reply <- serialReply{value: current, err: err}
+				continue
+			}
+			current = op.value
+			op.reply <- serialReply{value: current}
+		}
+	}
+}
+
+func (s *serialStore) Get(ctx context.Context) (Timestamp, error) {
+	reply := make(chan serialReply, 1)
+	select {
+	case s.ops <- serialOp{kind: serialOpGet, reply: reply}:
+	case <-ctx.Done():
+		return Timestamp{}, ctx.Err()
+	}
+
+	select {
+	case r := <-reply:
+		return r.value, r.err
+	case <-ctx.Done():
+		return Timestamp{}, ctx.Err()
+	}
+}
+
+func (s *serialStore) Set(ctx context.Context, value Timestamp) error {
+	reply := make(chan serialReply, 1)
+	select {
+	case s.ops <- serialOp{kind: serialOpSet, value: value, reply: reply}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case r := <-reply:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fileStore persists the timestamp as JSON in a single file, writing it atomically via a
+// temp-file-plus-rename on every Set so a crash mid-write can never leave a truncated file
+// behind, and loading it back on startup.
+type fileStore struct {
+	*serialStore
+	path string
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	initial, err := loadTimestampFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &fileStore{path: path}
+	fs.serialStore = newSerialStore(initial, fs.persist)
+
+	return fs, nil
+}
+
+func loadTimestampFromFile(path string) (Timestamp, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Timestamp{timestamp: &now}, nil
+	}
+	if err != nil {
+		return Timestamp{}, err
+	}
+
+	var ts Timestamp
+	if err := json.Unmarshal(raw, &ts); err != nil {
+		return Timestamp{}, err
+	}
+
+	return ts, nil
+}
+
+func (fs *fileStore) persist(value Timestamp) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), ".timestamp-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, fs.path)
+}
+
+// Close is a no-op: fileStore has nothing to release, it exists so callers can treat every
+// backend uniformly when tearing a Server down.
+func (fs *fileStore) Close() error {
+	return nil
+}
+
+// boltBucket/boltKey locate the single timestamp record kept in the bbolt database.
+var boltBucket = []byte("timestamp")
+var boltKey = []byte("current")
+
+// boltStore persists the timestamp in a boltdb/bbolt database, the same way fileStore persists to
+// a plain JSON file, but transactionally.
+type boltStore struct {
+	*serialStore
+	db *bbolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	initial, err := loadTimestampFromBolt(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	bs := &boltStore{db: db}
+	bs.serialStore = newSerialStore(initial, bs.persist)
+
+	return bs, nil
+}
+
+func loadTimestampFromBolt(db *bbolt.DB) (Timestamp, error) {
+	var result Timestamp
+
+	err := db.View(func(tx *bbolt.Tx) error {
+		raw := tx.Bucket(boltBucket).Get(boltKey)
+		if raw == nil {
+			result = Timestamp{timestamp: &now}
+			return nil
+		}
+		return json.Unmarshal(raw, &result)
+	})
+
+	return result, err
+}
+
+func (bs *boltStore) persist(value Timestamp) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(boltKey, raw)
+	})
+}
+
+func (bs *boltStore) Close() error {
+	return bs.db.Close()
+}
+
+// clientID identifies a registered subscriber of a memoryStore's hub.
+type clientID uint64
+
+// nextClientID hands out unique clientIDs for websocket subscribers.
+var nextClientID uint64
+
+// subscriber is what a websocket handler goroutine registers with a subscriberHub: its id, plus
+// the channel the hub publishes Timestamp updates into.
+type subscriber struct {
+	id clientID
+	ch chan Timestamp
+}
+
+// subscriberHub fans memoryStore updates out to every subscribed websocket connection. Like
+// memoryStore itself, it is owned by a single goroutine (run) and only ever touched through its
+// channels - still no mutexes, per RQ4.
+type subscriberHub struct {
+	register   chan subscriber
+	unregister chan clientID
+	broadcast  chan Timestamp
+	ready      chan struct{}
+}
+
+// wsSendBufferSize bounds how many undelivered updates a slow subscriber can queue before it is
+// evicted instead of stalling the hub.
+const wsSendBufferSize = 8
+
+func newSubscriberHub() *subscriberHub {
+	return &subscriberHub{
+		register:   make(chan subscriber),
+		unregister: make(chan clientID),
+		broadcast:  make(chan Timestamp),
+		ready:      make(chan struct{}),
+	}
+}
+
+// run owns the set of subscribed clients and must be started exactly once, before setData or any
+// websocket handler can be allowed to use h. It closes ready once its select loop is live, so
+// callers can wait for that instead of racing the first broadcast against goroutine startup.
+func (h *subscriberHub) run() {
+	clients := make(map[clientID]chan Timestamp)
+
+	close(h.ready)
+
+	for {
+		select {
+		case s := <-h.register:
+			clients[s.id] = s.ch
+
+		case id := <-h.unregister:
+			if ch, ok := clients[id]; ok {
+				delete(clients, id)
+				close(ch)
+			}
+
+		case ts := <-h.broadcast:
+			for id, ch := range clients {
+				select {
+				case ch <- ts:
+				default:
+					// Slow consumer: drop it rather than block every other subscriber.
+					delete(clients, id)
+					close(ch)
+				}
+			}
+		}
+	}
+}
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Config holds the tunables for the HTTP server started by Server.handleRequests.
+type Config struct {
+	// ListenAddress is passed to http.Server.Addr, e.g. ":10000".
+	ListenAddress string
+
+	// ReadTimeout, WriteTimeout, IdleTimeout and HeaderTimeout map directly onto the
+	// matching http.Server fields (HeaderTimeout -> ReadHeaderTimeout).
+	ReadTimeout   time.Duration
+	WriteTimeout  time.Duration
+	IdleTimeout   time.Duration
+	HeaderTimeout time.Duration
 }
 
-func storeTimestamp(w http.ResponseWriter, r *http.Request) {
+// timeoutSafetyMargin is subtracted from Config.WriteTimeout to derive the deadline given to
+// timeoutMiddleware, so the middleware always has time left to flush its own response before
+// http.Server would otherwise reset the connection.
+const timeoutSafetyMargin = 200 * time.Millisecond
+
+// DefaultConfig returns the Config used by main when none is supplied.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddress: ":10000",
+		ReadTimeout:   5 * time.Second,
+		WriteTimeout:  10 * time.Second,
+		IdleTimeout:   60 * time.Second,
+		HeaderTimeout: 2 * time.Second,
+	}
+}
+
+// timeoutWriter buffers a handler's response so it can either be copied out in full, or
+// discarded in favour of a timeout error, once the outcome of the race against the deadline is
+// known. It is only ever touched by the goroutine running the wrapped handler.
+type timeoutWriter struct {
+	header      http.Header
+	buf         bytes.Buffer
+	statusCode  int
+	wroteHeader bool
+}
+
+func newTimeoutWriter() *timeoutWriter {
+	return &timeoutWriter{header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *timeoutWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+}
+
+// timeoutMiddleware runs next under a context.WithTimeout derived from timeout. If next returns
+// before the deadline, its buffered response is copied to w verbatim with an explicit
+// Content-Length. If the deadline fires first, w receives a fully-buffered text/plain error
+// response instead - never chunked, since the terminating chunk could not be written after the
+// write deadline has already passed.
+func timeoutMiddleware(next http.HandlerFunc, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := newTimeoutWriter()
+		done := make(chan struct{})
+		go func() {
+			next(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			for key, values := range tw.header {
+				for _, value := range values {
+					w.Header().Add(key, value)
+				}
+			}
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", tw.buf.Len()))
+			w.WriteHeader(tw.statusCode)
+			_, _ = w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			errorMessage, _ := json.Marshal(Response{"Request processing timed out."})
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(errorMessage)))
+			w.WriteHeader(http.StatusGatewayTimeout)
+			_, _ = w.Write(errorMessage)
+		}
+	}
+}
+
+// CasRequest is the REST payload for PUT /timestamp/cas.
+type CasRequest struct {
+	Expected int64 `json:"expected"`
+	New      int64 `json:"new"`
+}
+
+// CasResponse reports whether a PUT /timestamp/cas request applied.
+type CasResponse struct {
+	Swapped bool `json:"swapped"`
+}
+
+// HistoryEntryJson is one entry in the GET /timestamp/history response.
+type HistoryEntryJson struct {
+	Timestamp int64     `json:"timestamp"`
+	WrittenAt time.Time `json:"writtenAt"`
+}
+
+// Server wires the HTTP layer to a pluggable Store backend, replacing the package-level globals
+// earlier revisions kept the timestamp in.
+type Server struct {
+	config Config
+	store  Store
+
+	// ready is closed by handleRequests once its listener is actually accepting connections, so
+	// callers can wait for that instead of racing net.Listen.
+	ready chan struct{}
+}
+
+// NewServer builds a Server that serves config.ListenAddress backed by store.
+func NewServer(config Config, store Store) *Server {
+	return &Server{config: config, store: store, ready: make(chan struct{})}
+}
+
+func (s *Server) returnTimestamp(w http.ResponseWriter, r *http.Request) {
+	value, err := s.store.Get(r.Context())
+	if err != nil {
+		log.Errorf("Unable to read stored timestamp. Error: %v", err)
+
+		errorMessage, _ := json.Marshal(Response{"Unable to read stored timestamp."})
+		http.Error(w, string(errorMessage), http.StatusInternalServerError)
+
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func (s *Server) storeTimestamp(w http.ResponseWriter, r *http.Request) {
 	reqBody, _ := ioutil.ReadAll(r.Body)
 	log.Debugf("reqBody: %+v\n", string(reqBody))
 
@@ -123,22 +721,214 @@ func storeTimestamp(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
-	setData(newData)
+
+	if err := s.store.Set(r.Context(), newData); err != nil {
+		log.Errorf("Unable to persist timestamp. Error: %v", err)
+
+		errorMessage, _ := json.Marshal(Response{"Unable to persist timestamp."})
+		http.Error(w, string(errorMessage), http.StatusInternalServerError)
+
+		return
+	}
 	log.Debugf("%v", newData)
 
 	_ = json.NewEncoder(w).Encode(Response{"OK"})
 }
 
-func handleRequests(c chan int) {
-	log.Debug("Start web server")
+func (s *Server) casTimestamp(w http.ResponseWriter, r *http.Request) {
+	swapper, ok := s.store.(Swapper)
+	if !ok {
+		errorMessage, _ := json.Marshal(Response{"Compare-and-swap is not supported by the configured store backend."})
+		http.Error(w, string(errorMessage), http.StatusNotImplemented)
+
+		return
+	}
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	log.Debugf("reqBody: %+v\n", string(reqBody))
+
+	var req CasRequest
+	if err := json.Unmarshal(reqBody, &req); err != nil {
+		log.Errorf("Unable to parse PUT payload as a valid json value. Error: %v", err)
+
+		// Do not expose too much about the internals.
+		errorMessage, _ := json.Marshal(Response{"Unable to parse PUT payload as a valid json value."})
+		http.Error(w, string(errorMessage), http.StatusInternalServerError)
+
+		return
+	}
+
+	expectedTime := time.Unix(req.Expected, 0)
+	newTime := time.Unix(req.New, 0)
+	swapped, err := swapper.CompareAndSwap(r.Context(), Timestamp{timestamp: &expectedTime}, Timestamp{timestamp: &newTime})
+	if err != nil {
+		log.Errorf("Unable to perform compare-and-swap. Error: %v", err)
+
+		errorMessage, _ := json.Marshal(Response{"Unable to perform compare-and-swap."})
+		http.Error(w, string(errorMessage), http.StatusInternalServerError)
+
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(CasResponse{Swapped: swapped})
+}
+
+func (s *Server) historyTimestamp(w http.ResponseWriter, r *http.Request) {
+	historian, ok := s.store.(Historian)
+	if !ok {
+		errorMessage, _ := json.Marshal(Response{"History is not supported by the configured store backend."})
+		http.Error(w, string(errorMessage), http.StatusNotImplemented)
+
+		return
+	}
+
+	n := 0
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			log.Errorf("Unable to parse n query parameter as a positive integer. Value: %v", raw)
+
+			errorMessage, _ := json.Marshal(Response{"Query parameter n must be a positive integer."})
+			http.Error(w, string(errorMessage), http.StatusBadRequest)
+
+			return
+		}
+		n = parsed
+	}
+
+	entries, err := historian.History(r.Context(), n)
+	if err != nil {
+		log.Errorf("Unable to read history. Error: %v", err)
+
+		errorMessage, _ := json.Marshal(Response{"Unable to read history."})
+		http.Error(w, string(errorMessage), http.StatusInternalServerError)
+
+		return
+	}
+
+	result := make([]HistoryEntryJson, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, HistoryEntryJson{Timestamp: entry.value.timestamp.Unix(), WrittenAt: entry.writtenAt})
+	}
+
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// subscribeTimestamp upgrades the connection to a websocket and pushes a JSON-encoded Timestamp,
+// in the same shape the REST endpoints use, every time the store is updated - an alternative to
+// polling GET /timestamp. It requires a Subscribable store backend.
+func (s *Server) subscribeTimestamp(w http.ResponseWriter, r *http.Request) {
+	subscribable, ok := s.store.(Subscribable)
+	if !ok {
+		http.Error(w, "Subscriptions are not supported by the configured store backend.", http.StatusNotImplemented)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("Unable to upgrade websocket connection. Error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	id := clientID(atomic.AddUint64(&nextClientID, 1))
+	events, err := subscribable.Subscribe(id)
+	if err != nil {
+		log.Errorf("Unable to subscribe to timestamp updates. Error: %v", err)
+		return
+	}
+	defer subscribable.Unsubscribe(id)
+
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		// We never expect incoming application messages on this endpoint; ReadMessage is only
+		// run to drive the pong handler and notice when the client goes away.
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ts, ok := <-events:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(ts)
+			if err != nil {
+				log.Errorf("Unable to marshal timestamp for websocket push. Error: %v", err)
+				continue
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
+
+// router builds the mux.Router wiring every REST/websocket endpoint to this Server's handlers.
+// Split out of handleRequests so tests can drive it through httptest without binding a fixed
+// port.
+func (s *Server) router() *mux.Router {
+	handlerTimeout := s.config.WriteTimeout - timeoutSafetyMargin
 
 	myRouter := mux.NewRouter().StrictSlash(true)
 
-	myRouter.HandleFunc("/timestamp", storeTimestamp).Methods("POST").Headers("Content-Type", "text/plain") // RQ2, RQ3
-	myRouter.HandleFunc("/timestamp", returnTimestamp).Methods("GET").Headers("Content-Type", "text/plain") // RQ2, RQ3
+	myRouter.HandleFunc("/timestamp", timeoutMiddleware(s.storeTimestamp, handlerTimeout)).Methods("POST").Headers("Content-Type", "text/plain")          // RQ2, RQ3
+	myRouter.HandleFunc("/timestamp", timeoutMiddleware(s.returnTimestamp, handlerTimeout)).Methods("GET").Headers("Content-Type", "text/plain")          // RQ2, RQ3
+	myRouter.HandleFunc("/timestamp/cas", timeoutMiddleware(s.casTimestamp, handlerTimeout)).Methods("PUT").Headers("Content-Type", "text/plain")         // RQ3
+	myRouter.HandleFunc("/timestamp/history", timeoutMiddleware(s.historyTimestamp, handlerTimeout)).Methods("GET").Headers("Content-Type", "text/plain") // RQ3
+	myRouter.HandleFunc("/timestamp/subscribe", s.subscribeTimestamp)
+
+	return myRouter
+}
+
+func (s *Server) handleRequests(c chan int) {
+	log.Debug("Start web server")
+
+	server := &http.Server{
+		Addr:              s.config.ListenAddress,
+		Handler:           s.router(),
+		ReadTimeout:       s.config.ReadTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		ReadHeaderTimeout: s.config.HeaderTimeout,
+	}
+
+	// Bind the listener ourselves, rather than leaving it to ListenAndServe, so we know exactly
+	// when it is safe to signal s.ready: callers must not race connecting against net.Listen.
+	listener, err := net.Listen("tcp", s.config.ListenAddress)
+	if err != nil {
+		log.Error(err)
+		close(s.ready)
+		c <- 0
+		return
+	}
+	close(s.ready)
 
-	// Listen on port 10 000 on all IP addresses of the machine. Log if something bad happen.
-	log.Error(http.ListenAndServe(":10000", myRouter))
+	// Listen on the configured address on all IP addresses of the machine. Log if something bad happen.
+	log.Error(server.Serve(listener))
 
 	log.Debug("Web server exited.")
 	c <- 0
@@ -211,15 +1001,84 @@ func getTimestampCall() (*int64, error) {
 	return &ts.Timestamp, nil
 }
 
+// Call REST endpoint to atomically swap the stored timestamp, only if it currently equals
+// expected. Returns whether the swap happened.
+func casTimestampCall(expected int64, newTimeStamp int64) (bool, error) {
+	log.Debug("Compare-and-swap timestamp via REST call")
+	bodyRaw := fmt.Sprintf(`{"expected": %d, "new": %d}`, expected, newTimeStamp)
+	body := []byte(bodyRaw)
+
+	client := &http.Client{}
+	request, _ := http.NewRequest(http.MethodPut, "http://localhost:10000/timestamp/cas", bytes.NewBuffer(body))
+	request.Header.Set("content-type", "text/plain") // RQ3
+	response, err := client.Do(request)
+
+	if err != nil {
+		log.Errorf("Error when calling REST endpoint. Error: %v", err)
+
+		return false, err
+	}
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Errorf("Error when calling REST endpoint. Error: %v", err)
+
+		return false, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		log.Errorf("Unexpected HTTP response code. Status code: %v. Message: %v", response.StatusCode, string(responseData))
+		return false, errors.New("Unexpected HTTP response code!")
+	}
+
+	result := CasResponse{}
+	if err := json.Unmarshal(responseData, &result); err != nil {
+		log.Errorf("Unable to parse request response as a json value. Error: %v", err)
+
+		return false, err
+	}
+
+	return result.Swapped, nil
+}
+
+// storeBackendFlag and storePathFlag select and configure the Store backend main wires up.
+var storeBackendFlag = flag.String("store", "memory", "storage backend to use: memory, file, or bolt")
+var storePathFlag = flag.String("store-path", "timestamp.json", "path to the backing file used by the file and bolt store backends")
+
+// newStoreFromFlags builds the Store backend selected by storeBackendFlag.
+func newStoreFromFlags() (Store, error) {
+	switch *storeBackendFlag {
+	case "memory":
+		return newMemoryStore(Timestamp{timestamp: &now}), nil
+	case "file":
+		return newFileStore(*storePathFlag)
+	case "bolt":
+		return newBoltStore(*storePathFlag)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", *storeBackendFlag)
+	}
+}
+
 func main() {
+	flag.Parse()
+
 	// Initialize logger
 	//log.SetLevel(log.TraceLevel)
 	log.SetLevel(log.ErrorLevel) // RQ6
 	log.Debug("IBM homework started")
 
+	backend, err := newStoreFromFlags()
+	if err != nil {
+		log.Errorf("Unable to initialize store backend. Error: %v", err)
+		return
+	}
+
+	server := NewServer(DefaultConfig(), backend)
+
 	// Start REST server (server part)
 	c := make(chan int)
-	go handleRequests(c)
+	go server.handleRequests(c)
+	<-server.ready // Wait for the listener to actually accept connections before calling it below.
 
 	// Trigger test REST calls (client part) -- RQ5
 
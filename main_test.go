@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gorilla/websocket"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -18,7 +24,9 @@ func TestMain(m *testing.M) {
 	// Now we are simple enough to keep it here.
 
 	c := make(chan int)
-	go handleRequests(c)
+	server := NewServer(DefaultConfig(), newMemoryStore(Timestamp{timestamp: &now}))
+	go server.handleRequests(c)
+	waitForServer("http://localhost:10000/timestamp", 2*time.Second)
 
 	// Run the test cases
 	exitCode := m.Run()
@@ -27,6 +35,19 @@ func TestMain(m *testing.M) {
 	os.Exit(exitCode)
 }
 
+// waitForServer polls url until it responds or timeout elapses, so tests started right after
+// `go server.handleRequests(c)` don't race the listener's bind.
+func waitForServer(url string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if response, err := http.Get(url); err == nil {
+			response.Body.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // Check if timestamp can be queried via REST calls.
 func TestGet(t *testing.T) {
 	ts, err := getTimestampCall()
@@ -109,6 +130,338 @@ func TestSetAndGetNegative(t *testing.T) {
 	}
 }
 
+// Check that a handler exceeding the deadline given to timeoutMiddleware produces a complete,
+// non-chunked text/plain error response instead of a truncated or reset connection.
+func TestTimeoutMiddlewareSlowHandler(t *testing.T) {
+	slowHandler := func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		time.Sleep(20 * time.Millisecond) // keep writing a little after the deadline fires
+		w.Write([]byte("too late"))
+	}
+
+	ts := httptest.NewServer(timeoutMiddleware(slowHandler, 10*time.Millisecond))
+	defer ts.Close()
+
+	response, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Error calling timeout-wrapped handler: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Unexpected status code: %v", response.StatusCode)
+	}
+
+	if response.TransferEncoding != nil {
+		t.Errorf("Response must not be chunked, got Transfer-Encoding: %v", response.TransferEncoding)
+	}
+
+	if response.ContentLength < 0 {
+		t.Errorf("Response must carry an explicit Content-Length")
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v", err)
+	}
+
+	if int64(len(body)) != response.ContentLength {
+		t.Errorf("Body length %v does not match Content-Length %v - response looks truncated", len(body), response.ContentLength)
+	}
+}
+
+// Check that a handler finishing within the deadline still gets its response copied through
+// timeoutMiddleware unchanged.
+func TestTimeoutMiddlewareFastHandler(t *testing.T) {
+	fastHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast response"))
+	}
+
+	ts := httptest.NewServer(timeoutMiddleware(fastHandler, 1*time.Second))
+	defer ts.Close()
+
+	response, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Error calling timeout-wrapped handler: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v", err)
+	}
+
+	if string(body) != "fast response" {
+		t.Errorf("Unexpected response body: %v", body)
+	}
+}
+
+// Check that every client subscribed to /timestamp/subscribe receives a push notification when
+// a new timestamp is stored via the REST endpoint.
+func TestWebSocketSubscribe(t *testing.T) {
+	wsURL := "ws://localhost:10000/timestamp/subscribe"
+
+	conn1, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Error dialing websocket endpoint: %v", err)
+	}
+	defer conn1.Close()
+
+	conn2, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Error dialing websocket endpoint: %v", err)
+	}
+	defer conn2.Close()
+
+	// Give the hub time to register both clients before we publish an update.
+	time.Sleep(50 * time.Millisecond)
+
+	newTimestamp := int64(1700000000)
+	if _, err := setTimestampCall(newTimestamp); err != nil {
+		t.Fatalf("Error in setTimestampCall: %v", err)
+	}
+
+	for _, conn := range []*websocket.Conn{conn1, conn2} {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading websocket notification: %v", err)
+		}
+
+		var ts TimestampJson
+		if err := json.Unmarshal(payload, &ts); err != nil {
+			t.Fatalf("Unable to parse websocket payload as json: %v", err)
+		}
+
+		if ts.Timestamp != newTimestamp {
+			t.Errorf("Incorrect timestamp received over websocket: %v", ts.Timestamp)
+		}
+	}
+}
+
+// Check that PUT /timestamp/cas only swaps the stored value when the caller's expectation
+// matches, and leaves it untouched otherwise.
+func TestCompareAndSwap(t *testing.T) {
+	current, err := getTimestampCall()
+	if err != nil {
+		t.Fatalf("Error in getTimestampCall: %v", err)
+	}
+
+	wrongExpectation := *current + 1
+	swapped, err := casTimestampCall(wrongExpectation, 42)
+	if err != nil {
+		t.Fatalf("Error in casTimestampCall: %v", err)
+	}
+	if swapped {
+		t.Errorf("CAS reported success despite a mismatching expected value")
+	}
+
+	unchanged, err := getTimestampCall()
+	if err != nil {
+		t.Fatalf("Error in getTimestampCall: %v", err)
+	}
+	if *unchanged != *current {
+		t.Errorf("Stored value changed after a failed CAS: %v", *unchanged)
+	}
+
+	swapped, err = casTimestampCall(*current, 42)
+	if err != nil {
+		t.Fatalf("Error in casTimestampCall: %v", err)
+	}
+	if !swapped {
+		t.Errorf("CAS reported failure despite a matching expected value")
+	}
+
+	updated, err := getTimestampCall()
+	if err != nil {
+		t.Fatalf("Error in getTimestampCall: %v", err)
+	}
+	if *updated != 42 {
+		t.Errorf("Stored value not updated after a successful CAS: %v", *updated)
+	}
+}
+
+// Check that GET /timestamp/history reports the values written by preceding Set/CAS calls, most
+// recent last, bounded by the n query parameter.
+func TestHistory(t *testing.T) {
+	if _, err := setTimestampCall(100); err != nil {
+		t.Fatalf("Error in setTimestampCall: %v", err)
+	}
+	if _, err := setTimestampCall(200); err != nil {
+		t.Fatalf("Error in setTimestampCall: %v", err)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "http://localhost:10000/timestamp/history?n=2", nil)
+	request.Header.Set("Content-Type", "text/plain") // RQ3
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error calling history endpoint: %v", err)
+	}
+	defer response.Body.Close()
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Error reading history response: %v", err)
+	}
+
+	var entries []HistoryEntryJson
+	if err := json.Unmarshal(responseData, &entries); err != nil {
+		t.Fatalf("Unable to parse history response as json: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 history entries, got %v", len(entries))
+	}
+
+	if entries[0].Timestamp != 100 || entries[1].Timestamp != 200 {
+		t.Errorf("Unexpected history entries: %+v", entries)
+	}
+}
+
+// Hammer the store actor from many goroutines performing a CAS-based increment loop, to prove
+// its single owner goroutine serializes every operation correctly: with no lost updates, the
+// final value must equal the starting value plus the number of goroutines.
+func TestStoreActorConcurrentCAS(t *testing.T) {
+	const workers = 50
+
+	start := int64(1000)
+	if _, err := setTimestampCall(start); err != nil {
+		t.Fatalf("Error in setTimestampCall: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				current, err := getTimestampCall()
+				if err != nil {
+					t.Errorf("Error in getTimestampCall: %v", err)
+					return
+				}
+
+				swapped, err := casTimestampCall(*current, *current+1)
+				if err != nil {
+					t.Errorf("Error in casTimestampCall: %v", err)
+					return
+				}
+				if swapped {
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	final, err := getTimestampCall()
+	if err != nil {
+		t.Fatalf("Error in getTimestampCall: %v", err)
+	}
+	if *final != start+workers {
+		t.Errorf("Expected final value %v after %v concurrent increments, got %v", start+workers, workers, *final)
+	}
+}
+
+// runConformanceChecks performs a POST-then-GET round trip against baseURL and asserts the value
+// read back matches what was written, exercising the REST surface independently of which Store
+// backend is behind it.
+func runConformanceChecks(t *testing.T, baseURL string) {
+	t.Helper()
+
+	newTimestamp := int64(555555555)
+	bodyRaw := fmt.Sprintf("{\"timestamp\" : %d}", newTimestamp)
+	postResponse, err := http.Post(baseURL+"/timestamp", "text/plain", bytes.NewBuffer([]byte(bodyRaw)))
+	if err != nil {
+		t.Fatalf("Error calling POST /timestamp: %v", err)
+	}
+	defer postResponse.Body.Close()
+	if postResponse.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code from POST /timestamp: %v", postResponse.StatusCode)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, baseURL+"/timestamp", nil)
+	request.Header.Set("Content-Type", "text/plain") // RQ3
+	getResponse, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error calling GET /timestamp: %v", err)
+	}
+	defer getResponse.Body.Close()
+
+	responseData, err := ioutil.ReadAll(getResponse.Body)
+	if err != nil {
+		t.Fatalf("Error reading GET /timestamp response: %v", err)
+	}
+
+	var ts TimestampJson
+	if err := json.Unmarshal(responseData, &ts); err != nil {
+		t.Fatalf("Unable to parse GET /timestamp response as json: %v", err)
+	}
+
+	if ts.Timestamp != newTimestamp {
+		t.Errorf("Incorrect timestamp received: %v, expected %v", ts.Timestamp, newTimestamp)
+	}
+}
+
+// Check that the REST API behaves the same regardless of which Store backend a Server is
+// configured with.
+func TestStoreConformance(t *testing.T) {
+	cases := []struct {
+		name     string
+		newStore func(t *testing.T) Store
+	}{
+		{
+			name: "memory",
+			newStore: func(t *testing.T) Store {
+				return newMemoryStore(Timestamp{timestamp: &now})
+			},
+		},
+		{
+			name: "file",
+			newStore: func(t *testing.T) Store {
+				store, err := newFileStore(filepath.Join(t.TempDir(), "timestamp.json"))
+				if err != nil {
+					t.Fatalf("Error creating file store: %v", err)
+				}
+				return store
+			},
+		},
+		{
+			name: "bolt",
+			newStore: func(t *testing.T) Store {
+				store, err := newBoltStore(filepath.Join(t.TempDir(), "timestamp.bolt"))
+				if err != nil {
+					t.Fatalf("Error creating bolt store: %v", err)
+				}
+				return store
+			},
+		},
+	}
+
+	for _, testCase := range cases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore(t)
+			if closer, ok := store.(interface{ Close() error }); ok {
+				t.Cleanup(func() { closer.Close() })
+			}
+
+			server := NewServer(DefaultConfig(), store)
+
+			// httptest.NewServer binds an ephemeral port, so parallel/repeated runs of this test
+			// never collide the way a hardcoded listen address would.
+			ts := httptest.NewServer(server.router())
+			t.Cleanup(ts.Close)
+
+			runConformanceChecks(t, ts.URL)
+		})
+	}
+}
+
 // Call REST endpoint to set current timestamp value.
 // String timestamp argument to allow non-integer timestamp values for negative test cases.
 func setTimestampCallStr(newTimeStampRaw string) (*string, error) {